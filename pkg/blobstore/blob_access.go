@@ -0,0 +1,67 @@
+package blobstore
+
+import (
+	"context"
+	"io"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// BlobAccess is an abstraction for a data store that can be used to
+// hold Content Addressable Storage (CAS) and Action Cache (AC)
+// objects. Objects are identified by a digest within the scope of an
+// instance name.
+type BlobAccess interface {
+	// Get returns a reader for the contents of an object. Any error
+	// that occurs while locating or fetching the object is
+	// reported through the returned ReadCloser, not through this
+	// call directly.
+	Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser
+
+	// Put stores an object of sizeBytes, reading its contents from r.
+	Put(ctx context.Context, instance string, digest *remoteexecution.Digest, sizeBytes int64, r io.ReadCloser) error
+
+	// Delete removes an object from the store.
+	Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error
+
+	// FindMissing returns the subset of digests that are not
+	// present in the store, so that clients can skip uploading
+	// objects that are already available.
+	FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error)
+
+	// PutMulti stores several objects in a single call, allowing
+	// backends to pipeline or batch the underlying operations
+	// instead of performing one round trip per object.
+	PutMulti(ctx context.Context, instance string, blobs []Blob) error
+
+	// GetStream is like Get, but hints that the caller will consume
+	// the result in chunks no larger than chunkSizeBytes. Backends
+	// with a chunked transport of their own (e.g. HTTP range
+	// requests) can use this to avoid holding an entire large blob
+	// in memory at once.
+	GetStream(ctx context.Context, instance string, digest *remoteexecution.Digest, chunkSizeBytes int) io.ReadCloser
+
+	// PutStream is like Put, but hints that the backend may write
+	// sizeBytes of data from r in chunks no larger than
+	// chunkSizeBytes.
+	PutStream(ctx context.Context, instance string, digest *remoteexecution.Digest, sizeBytes int64, chunkSizeBytes int, r io.ReadCloser) error
+}
+
+// Blob is a single object to be stored as part of a PutMulti() call.
+type Blob struct {
+	Digest    *remoteexecution.Digest
+	SizeBytes int64
+	Data      io.ReadCloser
+}
+
+const (
+	// DefaultChunkSizeBytes is the chunk size used to frame
+	// ByteStream Read/Write messages when a caller hasn't requested
+	// a specific size.
+	DefaultChunkSizeBytes = 2 << 20 // 2 MiB
+
+	// MaxChunkSizeBytes caps how large a single chunk may be, so
+	// that framed messages stay under gRPC's default max message
+	// size of 4 MiB.
+	MaxChunkSizeBytes = 4 << 20 // 4 MiB
+)
@@ -0,0 +1,155 @@
+// Package bytestream implements the v2 ByteStream gRPC service on
+// top of a blobstore.BlobAccess, so that large CAS blobs can be
+// streamed to and from clients in bounded-size chunks instead of
+// being transferred as a single gRPC message.
+package bytestream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	bytestream "google.golang.org/genproto/googleapis/bytestream"
+)
+
+type server struct {
+	blobAccess     blobstore.BlobAccess
+	chunkSizeBytes int
+}
+
+// NewServer creates a ByteStreamServer that reads and writes CAS
+// blobs in chunks of chunkSizeBytes. A value of zero selects
+// blobstore.DefaultChunkSizeBytes; values above
+// blobstore.MaxChunkSizeBytes are capped to it.
+func NewServer(blobAccess blobstore.BlobAccess, chunkSizeBytes int) bytestream.ByteStreamServer {
+	if chunkSizeBytes <= 0 {
+		chunkSizeBytes = blobstore.DefaultChunkSizeBytes
+	}
+	if chunkSizeBytes > blobstore.MaxChunkSizeBytes {
+		chunkSizeBytes = blobstore.MaxChunkSizeBytes
+	}
+	return &server{
+		blobAccess:     blobAccess,
+		chunkSizeBytes: chunkSizeBytes,
+	}
+}
+
+// parseResourceName extracts the instance name and Digest from a
+// ByteStream resource name, which embeds them as a "blobs/{hash}/
+// {size}" component. Write() resource names additionally carry an
+// "uploads/{uuid}/" segment immediately ahead of that component,
+// which is stripped from the instance name so that the blob ends up
+// stored under the same instance a subsequent Read() would look it
+// up under.
+func parseResourceName(name string) (string, *remoteexecution.Digest, error) {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if part == "blobs" && i+2 < len(parts) {
+			sizeBytes, err := strconv.ParseInt(parts[i+2], 10, 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid digest size in resource name %#v: %v", name, err)
+			}
+			instanceParts := parts[:i]
+			if i >= 2 && parts[i-2] == "uploads" {
+				instanceParts = parts[:i-2]
+			}
+			return strings.Join(instanceParts, "/"), &remoteexecution.Digest{
+				Hash:      parts[i+1],
+				SizeBytes: sizeBytes,
+			}, nil
+		}
+	}
+	return "", nil, fmt.Errorf("resource name %#v does not contain a blobs component", name)
+}
+
+func (s *server) Read(req *bytestream.ReadRequest, stream bytestream.ByteStream_ReadServer) error {
+	instance, digest, err := parseResourceName(req.ResourceName)
+	if err != nil {
+		return err
+	}
+
+	r := s.blobAccess.GetStream(stream.Context(), instance, digest, s.chunkSizeBytes)
+	defer r.Close()
+
+	buf := make([]byte, s.chunkSizeBytes)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if sendErr := stream.Send(&bytestream.ReadResponse{Data: buf[:n]}); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) Write(stream bytestream.ByteStream_WriteServer) error {
+	var digest *remoteexecution.Digest
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			pw.Close()
+			break
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			return err
+		}
+
+		if digest == nil {
+			var instance string
+			instance, digest, err = parseResourceName(req.ResourceName)
+			if err != nil {
+				pw.CloseWithError(err)
+				return err
+			}
+			go func() {
+				done <- s.blobAccess.PutStream(stream.Context(), instance, digest, digest.SizeBytes, s.chunkSizeBytes, pr)
+			}()
+		}
+
+		if len(req.Data) > 0 {
+			if _, err := pw.Write(req.Data); err != nil {
+				return err
+			}
+		}
+		if req.FinishWrite {
+			pw.Close()
+			break
+		}
+	}
+
+	if digest == nil {
+		// The stream ended before any WriteRequest arrived, so no
+		// PutStream() was ever started and done will never be
+		// written to. (A first WriteRequest without a resource
+		// name is already rejected by parseResourceName() above.)
+		return fmt.Errorf("Write() stream ended without a WriteRequest carrying a resource name")
+	}
+
+	if err := <-done; err != nil {
+		return err
+	}
+	return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: digest.SizeBytes})
+}
+
+func (s *server) QueryWriteStatus(ctx context.Context, req *bytestream.QueryWriteStatusRequest) (*bytestream.QueryWriteStatusResponse, error) {
+	// This server does not support resumable uploads: every Write()
+	// call is expected to run to completion or fail outright.
+	if _, _, err := parseResourceName(req.ResourceName); err != nil {
+		return nil, err
+	}
+	return &bytestream.QueryWriteStatusResponse{Complete: true}, nil
+}
@@ -0,0 +1,207 @@
+package bytestream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas/digest"
+	bytestream "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+)
+
+// fakeServerStream provides a no-op implementation of the parts of
+// grpc.ServerStream that Read()/Write() never exercise, so that
+// fakeReadServer/fakeWriteServer only need to implement the
+// ByteStream-specific methods.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// fakeReadServer collects the ReadResponses a Read() call sends,
+// standing in for the ByteStream_ReadServer a real gRPC transport
+// would provide.
+type fakeReadServer struct {
+	fakeServerStream
+	data bytes.Buffer
+}
+
+func (s *fakeReadServer) Send(resp *bytestream.ReadResponse) error {
+	s.data.Write(resp.Data)
+	return nil
+}
+
+// fakeWriteServer replays a fixed sequence of WriteRequests to a
+// Write() call, standing in for the ByteStream_WriteServer a real
+// gRPC transport would provide.
+type fakeWriteServer struct {
+	fakeServerStream
+	requests []*bytestream.WriteRequest
+	response *bytestream.WriteResponse
+}
+
+func (s *fakeWriteServer) Recv() (*bytestream.WriteRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+	req := s.requests[0]
+	s.requests = s.requests[1:]
+	return req, nil
+}
+
+func (s *fakeWriteServer) SendAndClose(resp *bytestream.WriteResponse) error {
+	s.response = resp
+	return nil
+}
+
+func TestParseResourceNameBlob(t *testing.T) {
+	instance, digest, err := parseResourceName("foo/bar/blobs/abc123/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance != "foo/bar" {
+		t.Errorf("instance = %q, want %q", instance, "foo/bar")
+	}
+	if digest.Hash != "abc123" || digest.SizeBytes != 42 {
+		t.Errorf("digest = %+v, want {Hash:abc123 SizeBytes:42}", digest)
+	}
+}
+
+func TestParseResourceNameUpload(t *testing.T) {
+	// Write() resource names carry an "uploads/{uuid}/" segment
+	// immediately ahead of the blobs component, which must be
+	// stripped from the instance name: otherwise a blob uploaded
+	// through Write() would be stored under a different instance
+	// than the one a matching Read() resource name resolves to.
+	instance, digest, err := parseResourceName("foo/uploads/5b1e/blobs/abc123/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance != "foo" {
+		t.Errorf("instance = %q, want %q", instance, "foo")
+	}
+	if digest.Hash != "abc123" || digest.SizeBytes != 42 {
+		t.Errorf("digest = %+v, want {Hash:abc123 SizeBytes:42}", digest)
+	}
+}
+
+func TestParseResourceNameUploadDefaultInstance(t *testing.T) {
+	// Same as above, but for the default (empty) instance name.
+	instance, _, err := parseResourceName("uploads/5b1e/blobs/abc123/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance != "" {
+		t.Errorf("instance = %q, want %q", instance, "")
+	}
+}
+
+func TestParseResourceNameWriteReadSameInstance(t *testing.T) {
+	// A Write() resource name and the Read()/blobs/... resource
+	// name for the same blob must resolve to the same instance, or
+	// a blob uploaded via Write() could never be found by Read().
+	writeInstance, _, err := parseResourceName("foo/bar/uploads/5b1e/blobs/abc123/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readInstance, _, err := parseResourceName("foo/bar/blobs/abc123/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if writeInstance != readInstance {
+		t.Errorf("Write() instance = %q, Read() instance = %q, want equal", writeInstance, readInstance)
+	}
+}
+
+func TestParseResourceNameNoBlobsComponent(t *testing.T) {
+	if _, _, err := parseResourceName("foo/bar"); err == nil {
+		t.Error("expected an error, got nil")
+	}
+}
+
+func TestParseResourceNameInvalidSize(t *testing.T) {
+	if _, _, err := parseResourceName("blobs/abc123/not-a-number"); err == nil {
+		t.Error("expected an error, got nil")
+	}
+}
+
+func TestServerWrite(t *testing.T) {
+	ctx := context.Background()
+	ba := blobstore.NewMemoryBlobAccess()
+	s := NewServer(ba, 0)
+
+	d, err := digest.Hash(digest.NewBytesSource([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &fakeWriteServer{
+		fakeServerStream: fakeServerStream{ctx: ctx},
+		requests: []*bytestream.WriteRequest{
+			{ResourceName: "uploads/5b1e/blobs/" + d.Hash + "/5", Data: []byte("hel")},
+			{Data: []byte("lo"), FinishWrite: true},
+		},
+	}
+
+	if err := s.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.response == nil || stream.response.CommittedSize != 5 {
+		t.Errorf("WriteResponse = %+v, want CommittedSize 5", stream.response)
+	}
+
+	r := ba.Get(ctx, "", d)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("stored blob = %q, want %q", data, "hello")
+	}
+}
+
+func TestServerWriteNoResourceName(t *testing.T) {
+	ctx := context.Background()
+	ba := blobstore.NewMemoryBlobAccess()
+	s := NewServer(ba, 0)
+
+	stream := &fakeWriteServer{
+		fakeServerStream: fakeServerStream{ctx: ctx},
+		requests: []*bytestream.WriteRequest{
+			{FinishWrite: true},
+		},
+	}
+
+	if err := s.Write(stream); err == nil {
+		t.Error("expected an error, got nil")
+	}
+}
+
+func TestServerRead(t *testing.T) {
+	ctx := context.Background()
+	ba := blobstore.NewMemoryBlobAccess()
+	d, err := digest.Hash(digest.NewBytesSource([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ba.Put(ctx, "", d, d.SizeBytes, ioutil.NopCloser(bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(ba, 0)
+	stream := &fakeReadServer{fakeServerStream: fakeServerStream{ctx: ctx}}
+	if err := s.Read(&bytestream.ReadRequest{ResourceName: "blobs/" + d.Hash + "/5"}, stream); err != nil {
+		t.Fatal(err)
+	}
+	if stream.data.String() != "hello" {
+		t.Errorf("Read() sent %q, want %q", stream.data.String(), "hello")
+	}
+}
@@ -0,0 +1,70 @@
+// Package cas implements the v2 ContentAddressableStorage gRPC
+// service's FindMissingBlobs and BatchUpdateBlobs methods on top of a
+// blobstore.BlobAccess, so that clients can batch small-object
+// existence checks and uploads at the start of a build instead of
+// making one ByteStream call per object.
+package cas
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	status "google.golang.org/genproto/googleapis/rpc/status"
+)
+
+type server struct {
+	remoteexecution.UnimplementedContentAddressableStorageServer
+
+	blobAccess blobstore.BlobAccess
+}
+
+// NewServer creates a ContentAddressableStorageServer that serves
+// FindMissingBlobs and BatchUpdateBlobs out of a BlobAccess based
+// CAS. Large-object transfer (BatchReadBlobs, GetTree, ...) is left
+// unimplemented, as that's served by the ByteStream API instead; see
+// pkg/blobstore/bytestream.
+func NewServer(blobAccess blobstore.BlobAccess) remoteexecution.ContentAddressableStorageServer {
+	return &server{blobAccess: blobAccess}
+}
+
+func (s *server) FindMissingBlobs(ctx context.Context, req *remoteexecution.FindMissingBlobsRequest) (*remoteexecution.FindMissingBlobsResponse, error) {
+	missing, err := s.blobAccess.FindMissing(ctx, req.InstanceName, req.BlobDigests)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteexecution.FindMissingBlobsResponse{MissingBlobDigests: missing}, nil
+}
+
+func (s *server) BatchUpdateBlobs(ctx context.Context, req *remoteexecution.BatchUpdateBlobsRequest) (*remoteexecution.BatchUpdateBlobsResponse, error) {
+	blobs := make([]blobstore.Blob, 0, len(req.Requests))
+	for _, r := range req.Requests {
+		blobs = append(blobs, blobstore.Blob{
+			Digest:    r.Digest,
+			SizeBytes: int64(len(r.Data)),
+			Data:      ioutil.NopCloser(bytes.NewReader(r.Data)),
+		})
+	}
+	err := s.blobAccess.PutMulti(ctx, req.InstanceName, blobs)
+
+	// blobstore.BlobAccess.PutMulti() fails or succeeds as a whole,
+	// so every response shares the same status; a backend able to
+	// report per-blob failures would need a richer PutMulti() return
+	// value to report them through here individually.
+	responses := make([]*remoteexecution.BatchUpdateBlobsResponse_Response, 0, len(req.Requests))
+	for _, r := range req.Requests {
+		resp := &remoteexecution.BatchUpdateBlobsResponse_Response{Digest: r.Digest}
+		if err != nil {
+			resp.Status = &status.Status{
+				Code:    13, // google.rpc.Code.INTERNAL
+				Message: err.Error(),
+			}
+		} else {
+			resp.Status = &status.Status{Code: 0 /* google.rpc.Code.OK */}
+		}
+		responses = append(responses, resp)
+	}
+	return &remoteexecution.BatchUpdateBlobsResponse{Responses: responses}, nil
+}
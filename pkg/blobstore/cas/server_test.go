@@ -0,0 +1,84 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas/digest"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+func TestServerFindMissingBlobs(t *testing.T) {
+	ctx := context.Background()
+	blobAccess := blobstore.NewMemoryBlobAccess()
+	present, err := digest.Hash(digest.NewBytesSource([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blobAccess.Put(ctx, "", present, present.SizeBytes, ioutil.NopCloser(bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	missing, err := digest.Hash(digest.NewBytesSource([]byte("absent")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(blobAccess)
+	resp, err := s.FindMissingBlobs(ctx, &remoteexecution.FindMissingBlobsRequest{
+		BlobDigests: []*remoteexecution.Digest{present, missing},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.MissingBlobDigests) != 1 || resp.MissingBlobDigests[0].Hash != missing.Hash {
+		t.Errorf("MissingBlobDigests = %v, want just %v", resp.MissingBlobDigests, missing)
+	}
+}
+
+func TestServerBatchUpdateBlobs(t *testing.T) {
+	ctx := context.Background()
+	blobAccess := blobstore.NewMemoryBlobAccess()
+	digestA, err := digest.Hash(digest.NewBytesSource([]byte("a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digestB, err := digest.Hash(digest.NewBytesSource([]byte("bb")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(blobAccess)
+	resp, err := s.BatchUpdateBlobs(ctx, &remoteexecution.BatchUpdateBlobsRequest{
+		Requests: []*remoteexecution.BatchUpdateBlobsRequest_Request{
+			{Digest: digestA, Data: []byte("a")},
+			{Digest: digestB, Data: []byte("bb")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Responses) != 2 {
+		t.Fatalf("Responses = %v, want 2 entries", resp.Responses)
+	}
+	for _, r := range resp.Responses {
+		if r.Status.Code != 0 {
+			t.Errorf("Responses[%s].Status = %v, want code 0 (OK)", r.Digest.Hash, r.Status)
+		}
+	}
+
+	for _, d := range []*remoteexecution.Digest{digestA, digestB} {
+		rd := blobAccess.Get(ctx, "", d)
+		data, err := ioutil.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Fatalf("blob %s was not stored: %v", d.Hash, err)
+		}
+		if int64(len(data)) != d.SizeBytes {
+			t.Errorf("blob %s = %d bytes, want %d", d.Hash, len(data), d.SizeBytes)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package dedup provides a BlobAccess decorator that deduplicates
+// concurrent requests for the same object, similar to BuildKit's
+// flightcontrol.Group.
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	getHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "buildbarn",
+		Subsystem: "blobstore_dedup",
+		Name:      "get_hits_total",
+		Help:      "Number of Get() calls that were coalesced into an in-flight fetch initiated by another caller.",
+	})
+	getMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "buildbarn",
+		Subsystem: "blobstore_dedup",
+		Name:      "get_misses_total",
+		Help:      "Number of Get() calls that triggered a new fetch against the underlying BlobAccess.",
+	})
+	putCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "buildbarn",
+		Subsystem: "blobstore_dedup",
+		Name:      "put_coalesced_total",
+		Help:      "Number of Put() calls that were coalesced into an in-flight upload initiated by another caller.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(getHits, getMisses, putCoalesced)
+}
+
+// inFlightGet is shared by every caller waiting on the same (instance,
+// digest) pair; its done channel is closed once the backend fetch has
+// completed, at which point data/err are safe to read by any waiter.
+type inFlightGet struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+type inFlightPut struct {
+	done chan struct{}
+	err  error
+}
+
+type dedupBlobAccess struct {
+	blobstore.BlobAccess
+
+	// streamThresholdBytes bounds how large an object may be before
+	// it is deduplicated. Buffering very large blobs in memory to
+	// avoid a thundering herd would cost more than the herd itself,
+	// so such blobs are passed straight through to the backend.
+	streamThresholdBytes int64
+
+	getsMutex sync.Mutex
+	gets      map[string]*inFlightGet
+
+	putsMutex sync.Mutex
+	puts      map[string]*inFlightPut
+}
+
+// NewBlobAccess creates a decorator for BlobAccess that deduplicates
+// concurrent Get() calls for the same object into a single backend
+// fetch, and concurrent Put() calls for the same object into a
+// single backend upload. Objects larger than streamThresholdBytes
+// bypass deduplication and stream straight through.
+func NewBlobAccess(blobAccess blobstore.BlobAccess, streamThresholdBytes int64) blobstore.BlobAccess {
+	return &dedupBlobAccess{
+		BlobAccess:           blobAccess,
+		streamThresholdBytes: streamThresholdBytes,
+		gets:                 map[string]*inFlightGet{},
+		puts:                 map[string]*inFlightPut{},
+	}
+}
+
+func key(instance string, digest *remoteexecution.Digest) string {
+	return instance + "/" + digest.Hash
+}
+
+func (ba *dedupBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	if digest.SizeBytes > ba.streamThresholdBytes {
+		return ba.BlobAccess.Get(ctx, instance, digest)
+	}
+	k := key(instance, digest)
+
+	ba.getsMutex.Lock()
+	if fetch, ok := ba.gets[k]; ok {
+		getHits.Inc()
+		ba.getsMutex.Unlock()
+		select {
+		case <-fetch.done:
+			return readerForResult(fetch.data, fetch.err)
+		case <-ctx.Done():
+			// Don't block a caller whose own context has expired on a
+			// fetch it isn't responsible for; the fetch itself is left
+			// to run to completion for whichever caller started it.
+			return readerForResult(nil, ctx.Err())
+		}
+	}
+	getMisses.Inc()
+	fetch := &inFlightGet{done: make(chan struct{})}
+	ba.gets[k] = fetch
+	ba.getsMutex.Unlock()
+
+	r := ba.BlobAccess.Get(ctx, instance, digest)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	fetch.data, fetch.err = data, err
+
+	ba.getsMutex.Lock()
+	delete(ba.gets, k)
+	ba.getsMutex.Unlock()
+	close(fetch.done)
+
+	return readerForResult(fetch.data, fetch.err)
+}
+
+func (ba *dedupBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, sizeBytes int64, r io.ReadCloser) error {
+	if sizeBytes > ba.streamThresholdBytes {
+		return ba.BlobAccess.Put(ctx, instance, digest, sizeBytes, r)
+	}
+	k := key(instance, digest)
+
+	ba.putsMutex.Lock()
+	if put, ok := ba.puts[k]; ok {
+		putCoalesced.Inc()
+		ba.putsMutex.Unlock()
+		// Objects are content addressed, so a Put() for a digest
+		// that's already being uploaded carries identical contents;
+		// simply wait for that upload to finish.
+		r.Close()
+		select {
+		case <-put.done:
+			return put.err
+		case <-ctx.Done():
+			// Don't block a caller whose own context has expired on an
+			// upload it isn't responsible for; the upload itself is
+			// left to run to completion for whichever caller started it.
+			return ctx.Err()
+		}
+	}
+	put := &inFlightPut{done: make(chan struct{})}
+	ba.puts[k] = put
+	ba.putsMutex.Unlock()
+
+	put.err = ba.BlobAccess.Put(ctx, instance, digest, sizeBytes, r)
+
+	ba.putsMutex.Lock()
+	delete(ba.puts, k)
+	ba.putsMutex.Unlock()
+	close(put.done)
+
+	return put.err
+}
+
+func readerForResult(data []byte, err error) io.ReadCloser {
+	if err != nil {
+		return ioutil.NopCloser(&errReader{err})
+	}
+	return ioutil.NopCloser(bytes.NewReader(data))
+}
+
+// errReader is a Reader that always fails with err, used to surface
+// a fetch error through the returned ReadCloser rather than through
+// Get() itself.
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,228 @@
+package dedup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// countingBlobAccess wraps a blobstore.BlobAccess and counts how many
+// times Get() and Put() reach the underlying backend, so that tests
+// can assert concurrent callers were coalesced into a single call.
+//
+// getGate/putGate, when non-nil, are read from before the call is
+// forwarded to the wrapped BlobAccess, letting a test hold the single
+// backend call open until every coalescing caller has registered
+// itself with the dedup layer. getEntered/putEntered, when non-nil,
+// are closed as soon as the call reaches the backend (i.e. once that
+// registration has happened), letting a test wait for the in-flight
+// entry to exist before depending on it.
+type countingBlobAccess struct {
+	blobstore.BlobAccess
+	gets, puts int32
+	getGate    <-chan struct{}
+	putGate    <-chan struct{}
+	getEntered chan struct{}
+	putEntered chan struct{}
+}
+
+func (ba *countingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	atomic.AddInt32(&ba.gets, 1)
+	if ba.getEntered != nil {
+		close(ba.getEntered)
+	}
+	if ba.getGate != nil {
+		<-ba.getGate
+	}
+	return ba.BlobAccess.Get(ctx, instance, digest)
+}
+
+func (ba *countingBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, sizeBytes int64, r io.ReadCloser) error {
+	atomic.AddInt32(&ba.puts, 1)
+	if ba.putEntered != nil {
+		close(ba.putEntered)
+	}
+	if ba.putGate != nil {
+		<-ba.putGate
+	}
+	return ba.BlobAccess.Put(ctx, instance, digest, sizeBytes, r)
+}
+
+func TestDedupBlobAccessGetCoalesces(t *testing.T) {
+	ctx := context.Background()
+	digest := &remoteexecution.Digest{Hash: "abc", SizeBytes: 5}
+	underlying := &countingBlobAccess{BlobAccess: blobstore.NewMemoryBlobAccess()}
+	if err := underlying.Put(ctx, "", digest, 5, ioutil.NopCloser(bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	underlying.puts = 0
+
+	// Hold the backend Get() open until the other 7 callers have
+	// joined the in-flight fetch (as counted by getHits), so the
+	// single in-flight fetch is guaranteed to still be registered
+	// when they look it up, rather than racing the scheduler to get
+	// there first.
+	gate := make(chan struct{})
+	underlying.getGate = gate
+
+	ba := NewBlobAccess(underlying, 1<<20)
+	hitsBefore := testutil.ToFloat64(getHits)
+
+	const concurrency = 8
+	var ready, wg sync.WaitGroup
+	ready.Add(concurrency)
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			ready.Done()
+			r := ba.Get(ctx, "", digest)
+			data, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(data) != "hello" {
+				t.Errorf("Get() = %q, want %q", data, "hello")
+			}
+		}()
+	}
+	ready.Wait()
+	for testutil.ToFloat64(getHits) < hitsBefore+concurrency-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&underlying.gets); got != 1 {
+		t.Errorf("underlying Get() called %d times, want 1", got)
+	}
+}
+
+func TestDedupBlobAccessPutCoalesces(t *testing.T) {
+	ctx := context.Background()
+	digest := &remoteexecution.Digest{Hash: "abc", SizeBytes: 5}
+	underlying := &countingBlobAccess{BlobAccess: blobstore.NewMemoryBlobAccess()}
+
+	// See TestDedupBlobAccessGetCoalesces: hold the backend Put() open
+	// until the other callers have joined the in-flight upload (as
+	// counted by putCoalesced).
+	gate := make(chan struct{})
+	underlying.putGate = gate
+
+	ba := NewBlobAccess(underlying, 1<<20)
+	coalescedBefore := testutil.ToFloat64(putCoalesced)
+
+	const concurrency = 8
+	var ready, wg sync.WaitGroup
+	ready.Add(concurrency)
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			ready.Done()
+			if err := ba.Put(ctx, "", digest, 5, ioutil.NopCloser(bytes.NewReader([]byte("hello")))); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	ready.Wait()
+	for testutil.ToFloat64(putCoalesced) < coalescedBefore+concurrency-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(gate)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&underlying.puts); got != 1 {
+		t.Errorf("underlying Put() called %d times, want 1", got)
+	}
+}
+
+func TestDedupBlobAccessGetJoiningWaiterRespectsContext(t *testing.T) {
+	ctx := context.Background()
+	digest := &remoteexecution.Digest{Hash: "abc", SizeBytes: 5}
+	underlying := &countingBlobAccess{BlobAccess: blobstore.NewMemoryBlobAccess()}
+	if err := underlying.Put(ctx, "", digest, 5, ioutil.NopCloser(bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the backend Get() open for the whole test, so the first
+	// caller's fetch never completes and the second caller is left
+	// waiting on it.
+	gate := make(chan struct{})
+	underlying.getGate = gate
+	defer close(gate)
+	entered := make(chan struct{})
+	underlying.getEntered = entered
+
+	ba := NewBlobAccess(underlying, 1<<20)
+
+	go ba.Get(ctx, "", digest)
+	<-entered
+
+	waiterCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := ba.Get(waiterCtx, "", digest)
+	_, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != waiterCtx.Err() {
+		t.Errorf("Get() error = %v, want %v", err, waiterCtx.Err())
+	}
+}
+
+func TestDedupBlobAccessPutJoiningWaiterRespectsContext(t *testing.T) {
+	ctx := context.Background()
+	digest := &remoteexecution.Digest{Hash: "abc", SizeBytes: 5}
+	underlying := &countingBlobAccess{BlobAccess: blobstore.NewMemoryBlobAccess()}
+
+	// Hold the backend Put() open for the whole test, so the first
+	// caller's upload never completes and the second caller is left
+	// waiting on it.
+	gate := make(chan struct{})
+	underlying.putGate = gate
+	defer close(gate)
+	entered := make(chan struct{})
+	underlying.putEntered = entered
+
+	ba := NewBlobAccess(underlying, 1<<20)
+
+	go ba.Put(ctx, "", digest, 5, ioutil.NopCloser(bytes.NewReader([]byte("hello"))))
+	<-entered
+
+	waiterCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ba.Put(waiterCtx, "", digest, 5, ioutil.NopCloser(bytes.NewReader([]byte("hello")))); err != waiterCtx.Err() {
+		t.Errorf("Put() error = %v, want %v", err, waiterCtx.Err())
+	}
+}
+
+func TestDedupBlobAccessBypassesLargeBlobs(t *testing.T) {
+	ctx := context.Background()
+	digest := &remoteexecution.Digest{Hash: "abc", SizeBytes: 10}
+	underlying := &countingBlobAccess{BlobAccess: blobstore.NewMemoryBlobAccess()}
+	ba := NewBlobAccess(underlying, 5)
+
+	if err := ba.Put(ctx, "", digest, 10, ioutil.NopCloser(bytes.NewReader([]byte("0123456789")))); err != nil {
+		t.Fatal(err)
+	}
+	r := ba.Get(ctx, "", digest)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123456789" {
+		t.Errorf("Get() = %q, want %q", data, "0123456789")
+	}
+}
@@ -0,0 +1,103 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+type memoryBlobAccess struct {
+	lock  sync.RWMutex
+	blobs map[string][]byte
+}
+
+// NewMemoryBlobAccess creates a BlobAccess that keeps all objects in
+// memory, using a simple map keyed by instance name and digest hash.
+// It is intended for testing and small, single-process deployments.
+func NewMemoryBlobAccess() BlobAccess {
+	return &memoryBlobAccess{
+		blobs: map[string][]byte{},
+	}
+}
+
+func (ba *memoryBlobAccess) key(instance string, digest *remoteexecution.Digest) string {
+	return instance + "/" + digest.Hash
+}
+
+func (ba *memoryBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	ba.lock.RLock()
+	data, ok := ba.blobs[ba.key(instance, digest)]
+	ba.lock.RUnlock()
+	if !ok {
+		return ioutil.NopCloser(&errNotFoundReader{fmt.Errorf("blob %s not found", digest.Hash)})
+	}
+	return ioutil.NopCloser(bytes.NewReader(data))
+}
+
+func (ba *memoryBlobAccess) Put(ctx context.Context, instance string, digest *remoteexecution.Digest, sizeBytes int64, r io.ReadCloser) error {
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	ba.lock.Lock()
+	ba.blobs[ba.key(instance, digest)] = data
+	ba.lock.Unlock()
+	return nil
+}
+
+func (ba *memoryBlobAccess) Delete(ctx context.Context, instance string, digest *remoteexecution.Digest) error {
+	ba.lock.Lock()
+	delete(ba.blobs, ba.key(instance, digest))
+	ba.lock.Unlock()
+	return nil
+}
+
+func (ba *memoryBlobAccess) FindMissing(ctx context.Context, instance string, digests []*remoteexecution.Digest) ([]*remoteexecution.Digest, error) {
+	ba.lock.RLock()
+	defer ba.lock.RUnlock()
+	var missing []*remoteexecution.Digest
+	for _, digest := range digests {
+		if _, ok := ba.blobs[ba.key(instance, digest)]; !ok {
+			missing = append(missing, digest)
+		}
+	}
+	return missing, nil
+}
+
+func (ba *memoryBlobAccess) PutMulti(ctx context.Context, instance string, blobs []Blob) error {
+	for _, blob := range blobs {
+		if err := ba.Put(ctx, instance, blob.Digest, blob.SizeBytes, blob.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetStream and PutStream ignore chunkSizeBytes: an in-memory map has
+// no chunked transport of its own to take advantage of, so chunking
+// only matters once the bytes leave this process (e.g. over the
+// ByteStream gRPC service).
+func (ba *memoryBlobAccess) GetStream(ctx context.Context, instance string, digest *remoteexecution.Digest, chunkSizeBytes int) io.ReadCloser {
+	return ba.Get(ctx, instance, digest)
+}
+
+func (ba *memoryBlobAccess) PutStream(ctx context.Context, instance string, digest *remoteexecution.Digest, sizeBytes int64, chunkSizeBytes int, r io.ReadCloser) error {
+	return ba.Put(ctx, instance, digest, sizeBytes, r)
+}
+
+// errNotFoundReader is returned by Get() for objects that aren't
+// present, so that the error surfaces through the returned
+// ReadCloser rather than through Get() itself.
+type errNotFoundReader struct {
+	err error
+}
+
+func (r *errNotFoundReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,76 @@
+package blobstore
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas/digest"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+func TestMemoryBlobAccessFindMissing(t *testing.T) {
+	ctx := context.Background()
+	ba := NewMemoryBlobAccess()
+
+	present, err := digest.Hash(digest.NewBytesSource([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ba.Put(ctx, "", present, present.SizeBytes, ioutil.NopCloser(bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+	absent, err := digest.Hash(digest.NewBytesSource([]byte("absent")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, err := ba.FindMissing(ctx, "", []*remoteexecution.Digest{present, absent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 1 || missing[0].Hash != absent.Hash {
+		t.Errorf("FindMissing() = %v, want just %v", missing, absent)
+	}
+}
+
+func TestMemoryBlobAccessPutMulti(t *testing.T) {
+	ctx := context.Background()
+	ba := NewMemoryBlobAccess()
+
+	digestA, err := digest.Hash(digest.NewBytesSource([]byte("a")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digestB, err := digest.Hash(digest.NewBytesSource([]byte("bb")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ba.PutMulti(ctx, "", []Blob{
+		{Digest: digestA, SizeBytes: digestA.SizeBytes, Data: ioutil.NopCloser(bytes.NewReader([]byte("a")))},
+		{Digest: digestB, SizeBytes: digestB.SizeBytes, Data: ioutil.NopCloser(bytes.NewReader([]byte("bb")))},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		digest *remoteexecution.Digest
+		data   string
+	}{
+		{digestA, "a"},
+		{digestB, "bb"},
+	} {
+		r := ba.Get(ctx, "", want.digest)
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("blob %s was not stored: %v", want.digest.Hash, err)
+		}
+		if string(data) != want.data {
+			t.Errorf("blob %s = %q, want %q", want.digest.Hash, data, want.data)
+		}
+	}
+}
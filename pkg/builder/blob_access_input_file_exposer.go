@@ -1,25 +1,28 @@
 package builder
 
 import (
+	"context"
 	"io"
 	"os"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
 
-	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
 )
 
 type blobAccessInputFileExposer struct {
 	contentAddressableStorage blobstore.BlobAccess
 }
 
+// NewBlobAccessInputFileExposer creates an InputFileExposer that
+// fetches objects from a BlobAccess based CAS.
 func NewBlobAccessInputFileExposer(contentAddressableStorage blobstore.BlobAccess) InputFileExposer {
 	return &blobAccessInputFileExposer{
 		contentAddressableStorage: contentAddressableStorage,
 	}
 }
 
-func (fe *blobAccessInputFileExposer) Expose(instance string, digest *remoteexecution.Digest, outputPath string, isExecutable bool) error {
+func (fe *blobAccessInputFileExposer) Expose(ctx context.Context, instance string, digest *remoteexecution.Digest, outputPath string, isExecutable bool) error {
 	var mode os.FileMode = 0444
 	if isExecutable {
 		mode = 0555
@@ -31,10 +34,15 @@ func (fe *blobAccessInputFileExposer) Expose(instance string, digest *remoteexec
 	defer f.Close()
 
 	// TODO(edsch): Translate NOT_FOUND to INVALID_PRECONDITION?
-	r, err := fe.contentAddressableStorage.Get(instance, digest)
-	if err != nil {
-		return err
+	var r io.ReadCloser
+	if digest.SizeBytes > blobstore.DefaultChunkSizeBytes {
+		// Stream large inputs (e.g. compiler toolchains) in bounded
+		// chunks instead of relying on the backend to buffer them.
+		r = fe.contentAddressableStorage.GetStream(ctx, instance, digest, blobstore.DefaultChunkSizeBytes)
+	} else {
+		r = fe.contentAddressableStorage.Get(ctx, instance, digest)
 	}
+	defer r.Close()
 	_, err = io.Copy(f, r)
 	return err
-}
\ No newline at end of file
+}
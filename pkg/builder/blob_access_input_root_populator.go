@@ -0,0 +1,184 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/golang/protobuf/proto"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// InputRootPopulator materializes the entire directory tree
+// described by an Action's input_root_digest onto local disk, so
+// that it may be used as the working directory of a build action
+// running on this worker.
+type InputRootPopulator interface {
+	Populate(ctx context.Context, instance string, digest *remoteexecution.Digest, outputPath string) error
+}
+
+// inputRootPopulatorConcurrency bounds the number of CAS fetches and
+// filesystem operations that may be in flight at the same time while
+// materializing a single input root.
+const inputRootPopulatorConcurrency = 32
+
+type blobAccessInputRootPopulator struct {
+	contentAddressableStorage blobstore.BlobAccess
+	inputFileExposer          InputFileExposer
+}
+
+// NewBlobAccessInputRootPopulator creates an InputRootPopulator that
+// walks Directory protos obtained from a BlobAccess based CAS,
+// exposing their contents through an InputFileExposer.
+func NewBlobAccessInputRootPopulator(contentAddressableStorage blobstore.BlobAccess, inputFileExposer InputFileExposer) InputRootPopulator {
+	return &blobAccessInputRootPopulator{
+		contentAddressableStorage: contentAddressableStorage,
+		inputFileExposer:          inputFileExposer,
+	}
+}
+
+// directoryFetch deduplicates concurrent requests for the same
+// Directory digest, which commonly occurs when a subtree (e.g. a
+// vendored dependency) is referenced from multiple places within the
+// same input root.
+type directoryFetch struct {
+	done      chan struct{}
+	directory remoteexecution.Directory
+	err       error
+}
+
+// populateState carries the state shared by all goroutines walking a
+// single input root.
+type populateState struct {
+	ctx                        context.Context
+	instance                   string
+	contentAddressableStorage blobstore.BlobAccess
+	inputFileExposer           InputFileExposer
+
+	semaphore chan struct{}
+
+	directoriesMutex sync.Mutex
+	directories      map[string]*directoryFetch
+}
+
+func (ps *populateState) getDirectory(digest *remoteexecution.Digest) (*remoteexecution.Directory, error) {
+	ps.directoriesMutex.Lock()
+	fetch, ok := ps.directories[digest.Hash]
+	if ok {
+		ps.directoriesMutex.Unlock()
+		<-fetch.done
+		return &fetch.directory, fetch.err
+	}
+	fetch = &directoryFetch{done: make(chan struct{})}
+	ps.directories[digest.Hash] = fetch
+	ps.directoriesMutex.Unlock()
+
+	// Bound Directory proto fetches against the same semaphore used
+	// for file/symlink leaf work, so that a wide input tree cannot
+	// fan out one concurrent CAS Get per directory with no cap.
+	ps.semaphore <- struct{}{}
+	r := ps.contentAddressableStorage.Get(ps.ctx, ps.instance, digest)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	<-ps.semaphore
+	if err == nil {
+		err = proto.Unmarshal(data, &fetch.directory)
+	}
+	fetch.err = err
+	close(fetch.done)
+	return &fetch.directory, fetch.err
+}
+
+// populateDirectory recursively materializes a single Directory
+// proto and all of its descendants at outputPath. outputPath itself
+// is assumed to already exist; populateDirectory only creates the
+// directories for its children.
+func (ps *populateState) populateDirectory(digest *remoteexecution.Digest, outputPath string) error {
+	directory, err := ps.getDirectory(digest)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(directory.Files)+len(directory.Directories)+len(directory.Symlinks))
+
+	// run bounds I/O-heavy leaf work (CAS fetches and file writes)
+	// against the shared semaphore.
+	run := func(f func() error) {
+		wg.Add(1)
+		ps.semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-ps.semaphore }()
+			errs <- f()
+		}()
+	}
+	// recurse fans out into a subdirectory without holding a
+	// semaphore slot for the lifetime of the subtree. Doing that
+	// bookkeeping through run() instead would have a goroutine hold
+	// its slot across its own descendants' wg.Wait(), and once
+	// inputRootPopulatorConcurrency siblings all need to recurse
+	// further, none of them could ever acquire the slot their
+	// children need: a guaranteed deadlock.
+	recurse := func(f func() error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- f()
+		}()
+	}
+
+	for _, file := range directory.Files {
+		file := file
+		run(func() error {
+			return ps.inputFileExposer.Expose(ps.ctx, ps.instance, file.Digest, filepath.Join(outputPath, file.Name), file.IsExecutable)
+		})
+	}
+	for _, symlink := range directory.Symlinks {
+		symlink := symlink
+		run(func() error {
+			return os.Symlink(symlink.Target, filepath.Join(outputPath, symlink.Name))
+		})
+	}
+	for _, child := range directory.Directories {
+		child := child
+		recurse(func() error {
+			childPath := filepath.Join(outputPath, child.Name)
+			if err := os.Mkdir(childPath, 0777); err != nil {
+				return err
+			}
+			return ps.populateDirectory(child.Digest, childPath)
+		})
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Populate creates outputPath (which may already exist, as callers
+// commonly materialize input roots into a scratch directory they
+// created themselves) and recursively fills it in from the CAS.
+func (fe *blobAccessInputRootPopulator) Populate(ctx context.Context, instance string, digest *remoteexecution.Digest, outputPath string) error {
+	if err := os.MkdirAll(outputPath, 0777); err != nil {
+		return err
+	}
+	ps := &populateState{
+		ctx:                        ctx,
+		instance:                   instance,
+		contentAddressableStorage: fe.contentAddressableStorage,
+		inputFileExposer:           fe.inputFileExposer,
+		semaphore:                  make(chan struct{}, inputRootPopulatorConcurrency),
+		directories:                map[string]*directoryFetch{},
+	}
+	return ps.populateDirectory(digest, outputPath)
+}
@@ -0,0 +1,172 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas/digest"
+	"github.com/golang/protobuf/proto"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// putBlob hashes and stores data, returning its Digest.
+func putBlob(t *testing.T, ctx context.Context, blobAccess blobstore.BlobAccess, data []byte) *remoteexecution.Digest {
+	d, err := digest.Hash(digest.NewBytesSource(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := blobAccess.Put(ctx, "", d, d.SizeBytes, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// putDirectory marshals and stores a Directory proto, returning its
+// Digest so that it can be referenced from a parent Directory or
+// passed directly to Populate().
+func putDirectory(t *testing.T, ctx context.Context, blobAccess blobstore.BlobAccess, directory *remoteexecution.Directory) *remoteexecution.Digest {
+	data, err := proto.Marshal(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return putBlob(t, ctx, blobAccess, data)
+}
+
+func TestBlobAccessInputRootPopulatorPopulate(t *testing.T) {
+	ctx := context.Background()
+	contentAddressableStorage := blobstore.NewMemoryBlobAccess()
+	inputFileExposer := NewBlobAccessInputFileExposer(contentAddressableStorage)
+	populator := NewBlobAccessInputRootPopulator(contentAddressableStorage, inputFileExposer)
+
+	fileDigest := putBlob(t, ctx, contentAddressableStorage, []byte("hello"))
+	subDigest := putDirectory(t, ctx, contentAddressableStorage, &remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{Name: "b.txt", Digest: fileDigest},
+		},
+	})
+	rootDigest := putDirectory(t, ctx, contentAddressableStorage, &remoteexecution.Directory{
+		Files: []*remoteexecution.FileNode{
+			{Name: "a.txt", Digest: fileDigest},
+		},
+		Directories: []*remoteexecution.DirectoryNode{
+			{Name: "sub", Digest: subDigest},
+		},
+	})
+
+	// Populate() must be able to materialize into an output
+	// directory that the caller already created (e.g. via
+	// ioutil.TempDir), not just into one that doesn't exist yet.
+	outputPath, err := ioutil.TempDir("", "input-root-populator-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputPath)
+
+	if err := populator.Populate(ctx, "", rootDigest, outputPath); err != nil {
+		t.Fatalf("Populate() failed: %v", err)
+	}
+
+	for _, relPath := range []string{"a.txt", "sub/b.txt"} {
+		data, err := ioutil.ReadFile(filepath.Join(outputPath, relPath))
+		if err != nil {
+			t.Fatalf("reading %s: %v", relPath, err)
+		}
+		if string(data) != "hello" {
+			t.Errorf("%s: got %q, want %q", relPath, data, "hello")
+		}
+	}
+}
+
+// concurrencyTrackingBlobAccess wraps a blobstore.BlobAccess and
+// records the highest number of Get() calls ever in flight at once,
+// so that tests can assert the populator's fan-out stays bounded.
+type concurrencyTrackingBlobAccess struct {
+	blobstore.BlobAccess
+	current, max int64
+}
+
+func (ba *concurrencyTrackingBlobAccess) Get(ctx context.Context, instance string, digest *remoteexecution.Digest) io.ReadCloser {
+	cur := atomic.AddInt64(&ba.current, 1)
+	for {
+		prevMax := atomic.LoadInt64(&ba.max)
+		if cur <= prevMax || atomic.CompareAndSwapInt64(&ba.max, prevMax, cur) {
+			break
+		}
+	}
+	defer atomic.AddInt64(&ba.current, -1)
+	r := ba.BlobAccess.Get(ctx, instance, digest)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	return ioutil.NopCloser(bytes.NewReader(data))
+}
+
+// TestBlobAccessInputRootPopulatorBoundsConcurrency builds a tree
+// wider than inputRootPopulatorConcurrency, each subdirectory needing
+// further recursion, and checks that it both completes (i.e. does
+// not deadlock) and never exceeds the configured concurrency cap on
+// CAS fetches.
+func TestBlobAccessInputRootPopulatorBoundsConcurrency(t *testing.T) {
+	ctx := context.Background()
+	memory := blobstore.NewMemoryBlobAccess()
+	tracking := &concurrencyTrackingBlobAccess{BlobAccess: memory}
+	inputFileExposer := NewBlobAccessInputFileExposer(tracking)
+	populator := NewBlobAccessInputRootPopulator(tracking, inputFileExposer)
+
+	fileDigest := putBlob(t, ctx, memory, []byte("x"))
+
+	const width = inputRootPopulatorConcurrency * 2
+	var children []*remoteexecution.DirectoryNode
+	for i := 0; i < width; i++ {
+		leafDigest := putDirectory(t, ctx, memory, &remoteexecution.Directory{
+			Files: []*remoteexecution.FileNode{
+				{Name: "leaf.txt", Digest: fileDigest},
+			},
+		})
+		midDigest := putDirectory(t, ctx, memory, &remoteexecution.Directory{
+			Directories: []*remoteexecution.DirectoryNode{
+				{Name: "leaf", Digest: leafDigest},
+			},
+		})
+		children = append(children, &remoteexecution.DirectoryNode{
+			Name:   fmt.Sprintf("mid%d", i),
+			Digest: midDigest,
+		})
+	}
+	rootDigest := putDirectory(t, ctx, memory, &remoteexecution.Directory{Directories: children})
+
+	outputPath, err := ioutil.TempDir("", "input-root-populator-concurrency-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputPath)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- populator.Populate(ctx, "", rootDigest, outputPath)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Populate() failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Populate() deadlocked on a tree wider than inputRootPopulatorConcurrency")
+	}
+
+	if max := atomic.LoadInt64(&tracking.max); max > inputRootPopulatorConcurrency {
+		t.Errorf("peak concurrent Get() calls = %d, want <= %d", max, inputRootPopulatorConcurrency)
+	}
+}
@@ -0,0 +1,13 @@
+package builder
+
+import (
+	"context"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// BuildExecutor can execute a build action, as described by a v2
+// ExecuteRequest, and returns its outcome as an ExecuteResponse.
+type BuildExecutor interface {
+	Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, error)
+}
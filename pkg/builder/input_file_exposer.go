@@ -0,0 +1,13 @@
+package builder
+
+import (
+	"context"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// InputFileExposer places a single CAS object onto local disk, so
+// that it may be consumed by a build action running on this worker.
+type InputFileExposer interface {
+	Expose(ctx context.Context, instance string, digest *remoteexecution.Digest, outputPath string, isExecutable bool) error
+}
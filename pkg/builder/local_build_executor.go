@@ -1,81 +1,263 @@
 package builder
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas/digest"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 
-	remoteexecution "google.golang.org/genproto/googleapis/devtools/remoteexecution/v1test"
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	status "google.golang.org/genproto/googleapis/rpc/status"
 )
 
 type localBuildExecutor struct {
 	contentAddressableStorage blobstore.BlobAccess
+	inputRootPopulator        InputRootPopulator
+	digestCache               digest.DigestCache
+	options                   BuildExecutorOptions
 }
 
-func NewLocalBuildExecutor(contentAddressableStorage blobstore.BlobAccess) BuildExecutor {
+// NewLocalBuildExecutor creates a BuildExecutor that runs actions
+// directly on the local machine in a scratch directory, fetching
+// inputs from and uploading outputs into a BlobAccess based CAS.
+// Output file digests are computed through digestCache, keyed by
+// their path inside the action's scratch directory; as every
+// execution gets a new scratch directory, an entry added by one
+// execution is not reused by a later one. options controls how an Action's overall timeout is
+// divided across the phases of Execute().
+func NewLocalBuildExecutor(contentAddressableStorage blobstore.BlobAccess, inputRootPopulator InputRootPopulator, digestCache digest.DigestCache, options BuildExecutorOptions) BuildExecutor {
 	return &localBuildExecutor{
 		contentAddressableStorage: contentAddressableStorage,
+		inputRootPopulator:        inputRootPopulator,
+		digestCache:               digestCache,
+		options:                   options,
 	}
 }
 
-func (be *localBuildExecutor) Execute(request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, error) {
-	log.Print("Got ExecuteRequest:", request)
-
-	r, err := be.contentAddressableStorage.Get(request.InstanceName, request.Action.CommandDigest)
+func (be *localBuildExecutor) getMessage(ctx context.Context, instance string, digest *remoteexecution.Digest, message proto.Message) error {
+	r := be.contentAddressableStorage.Get(ctx, instance, digest)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		log.Print("Execution.Execute: ", err)
-		return nil, err
+		return err
 	}
-	commandData, err := ioutil.ReadAll(r)
-	if err != nil {
-		log.Print("Execution.Execute: ", err)
-		return nil, err
+	return proto.Unmarshal(data, message)
+}
+
+func infraFailure(code int32, err error) (*remoteexecution.ExecuteResponse, error) {
+	return &remoteexecution.ExecuteResponse{
+		Status: &status.Status{
+			Code:    code,
+			Message: err.Error(),
+		},
+	}, nil
+}
+
+// actionPlatform returns the Platform properties that apply to an
+// action, preferring Action.Platform (the field REAPI v2.2 moved
+// platform selection to) over the deprecated Command.Platform it
+// supersedes.
+func actionPlatform(action *remoteexecution.Action, command *remoteexecution.Command) *remoteexecution.Platform {
+	if action.Platform != nil {
+		return action.Platform
+	}
+	return command.Platform
+}
+
+// checkPlatform verifies that every property an action's Platform
+// requires is satisfied by this worker's own properties, so that an
+// action requiring a platform this worker cannot provide (a
+// different OS, a missing toolchain, ...) is rejected up front
+// instead of silently running anyway in a mismatched environment.
+// A nil provided map disables the check.
+func checkPlatform(required *remoteexecution.Platform, provided map[string]string) error {
+	if provided == nil {
+		return nil
+	}
+	for _, property := range required.GetProperties() {
+		if value, ok := provided[property.Name]; !ok || value != property.Value {
+			return fmt.Errorf("worker does not satisfy platform property %#v: %#v", property.Name, property.Value)
+		}
+	}
+	return nil
+}
+
+// phaseFailure reports the failure of a phase, translating the
+// phase's own budgeted sub-deadline being exceeded into the same
+// DEADLINE_EXCEEDED response used when the Action's overall timeout
+// is exceeded during PhaseExec, rather than treating it as an
+// infrastructure failure.
+func phaseFailure(phaseCtx context.Context, err error) (*remoteexecution.ExecuteResponse, error) {
+	if phaseCtx.Err() == context.DeadlineExceeded {
+		return &remoteexecution.ExecuteResponse{
+			Status: &status.Status{
+				Code:    4, // google.rpc.Code.DEADLINE_EXCEEDED
+				Message: "Action exceeded its timeout",
+			},
+		}, nil
+	}
+	return infraFailure(13 /* google.rpc.Code.INTERNAL */, err)
+}
+
+func (be *localBuildExecutor) Execute(ctx context.Context, request *remoteexecution.ExecuteRequest) (*remoteexecution.ExecuteResponse, error) {
+	log.Print("Got ExecuteRequest: ", request)
+	metadata := &remoteexecution.ExecutedActionMetadata{
+		Worker:          "localhost",
+		QueuedTimestamp: ptypes.TimestampNow(),
 	}
+	actionDigest := request.ActionDigest
+
+	var action remoteexecution.Action
 	var command remoteexecution.Command
-	if err := proto.Unmarshal(commandData, &command); err != nil {
-		log.Print("Execution.Execute: ", err)
-		return nil, err
+	if phaseCtx, err := runPhase(ctx, PhaseInventory, be.options.inventoryBudget(), request.InstanceName, actionDigest, func(ctx context.Context) error {
+		if err := be.getMessage(ctx, request.InstanceName, request.ActionDigest, &action); err != nil {
+			return err
+		}
+		return be.getMessage(ctx, request.InstanceName, action.CommandDigest, &command)
+	}); err != nil {
+		log.Print("Execution.Execute: failed during inventory: ", err)
+		return phaseFailure(phaseCtx, err)
 	}
-	log.Print("Got command: ", command)
+	log.Print("Got command: ", &command)
 
-	r, err = be.contentAddressableStorage.Get(request.InstanceName, request.Action.InputRootDigest)
-	if err != nil {
-		log.Print("Execution.Execute: ", err)
-		return nil, err
+	if len(command.Arguments) == 0 {
+		return infraFailure(9 /* google.rpc.Code.FAILED_PRECONDITION */, errors.New("command has no arguments"))
 	}
-	inputRootData, err := ioutil.ReadAll(r)
+
+	if err := checkPlatform(actionPlatform(&action, &command), be.options.Platform); err != nil {
+		log.Print("Execution.Execute: platform mismatch: ", err)
+		return infraFailure(9 /* google.rpc.Code.FAILED_PRECONDITION */, err)
+	}
+
+	var totalTimeout time.Duration
+	if action.Timeout != nil {
+		t, err := ptypes.Duration(action.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		totalTimeout = t
+	}
+
+	// Every action gets its own scratch directory, so that concurrent
+	// actions on this worker cannot observe each other's inputs or
+	// outputs.
+	scratchDir, err := ioutil.TempDir("", "buildbarn-action")
 	if err != nil {
-		log.Print("Execution.Execute: ", err)
 		return nil, err
 	}
-	var inputRoot remoteexecution.Directory
-	if err := proto.Unmarshal(inputRootData, &inputRoot); err != nil {
-		log.Print("Execution.Execute: ", err)
-		return nil, err
+	defer os.RemoveAll(scratchDir)
+
+	metadata.WorkerStartTimestamp = ptypes.TimestampNow()
+	metadata.InputFetchStartTimestamp = metadata.WorkerStartTimestamp
+	if phaseCtx, err := runPhase(ctx, PhaseInputTree, be.options.budget(be.options.InputTreeFraction, totalTimeout), request.InstanceName, actionDigest, func(ctx context.Context) error {
+		return be.inputRootPopulator.Populate(ctx, request.InstanceName, action.InputRootDigest, scratchDir)
+	}); err != nil {
+		log.Print("Execution.Execute: failed to populate input root: ", err)
+		return phaseFailure(phaseCtx, err)
 	}
-	log.Print("Got input root: ", inputRoot)
+	metadata.InputFetchCompletedTimestamp = ptypes.TimestampNow()
 
-	// TODO(edsch): Use CommandContext(), so we have a proper timeout.
-	// TODO(edsch): Test len(command.Arguments) properly!
-	cmd := exec.Command(command.Arguments[0], command.Arguments...)
-	for _, environmentVariable := range command.EnvironmentVariables {
-		cmd.Env = append(cmd.Env, environmentVariable.Name+"="+environmentVariable.Value)
+	var cmd *exec.Cmd
+	var stdout, stderr bytes.Buffer
+	if phaseCtx, err := runPhase(ctx, PhaseSetup, be.options.budget(be.options.SetupFraction, totalTimeout), request.InstanceName, actionDigest, func(ctx context.Context) error {
+		return nil
+	}); err != nil {
+		return phaseFailure(phaseCtx, err)
 	}
-	if err := cmd.Run(); err != nil {
+
+	metadata.ExecutionStartTimestamp = ptypes.TimestampNow()
+	var runErr error
+	execCtx, _ := runPhase(ctx, PhaseExec, be.options.budget(be.options.ExecFraction, totalTimeout), request.InstanceName, actionDigest, func(ctx context.Context) error {
+		cmd = exec.CommandContext(ctx, command.Arguments[0], command.Arguments[1:]...)
+		cmd.Dir = scratchDir
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		for _, environmentVariable := range command.EnvironmentVariables {
+			cmd.Env = append(cmd.Env, environmentVariable.Name+"="+environmentVariable.Value)
+		}
+		runErr = cmd.Run()
+		return nil
+	})
+	metadata.ExecutionCompletedTimestamp = ptypes.TimestampNow()
+
+	if execCtx.Err() == context.DeadlineExceeded {
 		return &remoteexecution.ExecuteResponse{
-			Result: &remoteexecution.ActionResult{
-				ExitCode:  123,
-				StderrRaw: []byte(err.Error() + "\n"),
+			Status: &status.Status{
+				Code:    4, // google.rpc.Code.DEADLINE_EXCEEDED
+				Message: "Action exceeded its timeout",
 			},
 		}, nil
 	}
+
+	exitCode := int32(0)
+	if exitErr, ok := runErr.(*exec.ExitError); ok {
+		exitCode = int32(exitErr.Sys().(syscall.WaitStatus).ExitStatus())
+	} else if runErr != nil {
+		// The command could not even be started; this is an
+		// infrastructure failure, not an action failure.
+		return infraFailure(2 /* google.rpc.Code.UNKNOWN */, runErr)
+	}
+
+	metadata.OutputUploadStartTimestamp = ptypes.TimestampNow()
+	var result *remoteexecution.ActionResult
+	uploadPhaseCtx, uploadErr := runPhase(ctx, PhaseOutputUpload, be.options.budget(be.options.OutputUploadFraction, totalTimeout), request.InstanceName, actionDigest, func(ctx context.Context) error {
+		stdoutDigest, err := digestAndUploadBlob(ctx, be.contentAddressableStorage, request.InstanceName, stdout.Bytes())
+		if err != nil {
+			return err
+		}
+		stderrDigest, err := digestAndUploadBlob(ctx, be.contentAddressableStorage, request.InstanceName, stderr.Bytes())
+		if err != nil {
+			return err
+		}
+
+		result = &remoteexecution.ActionResult{
+			ExitCode:          exitCode,
+			StdoutDigest:      stdoutDigest,
+			StderrDigest:      stderrDigest,
+			ExecutionMetadata: metadata,
+		}
+		for _, outputFile := range command.OutputFiles {
+			if _, err := os.Stat(filepath.Join(scratchDir, outputFile)); err != nil {
+				continue
+			}
+			file, err := uploadOutputFile(ctx, be.contentAddressableStorage, be.digestCache, request.InstanceName, scratchDir, outputFile)
+			if err != nil {
+				return err
+			}
+			result.OutputFiles = append(result.OutputFiles, file)
+		}
+		for _, outputDirectory := range command.OutputDirectories {
+			if _, err := os.Stat(filepath.Join(scratchDir, outputDirectory)); err != nil {
+				continue
+			}
+			directory, err := uploadOutputDirectory(ctx, be.contentAddressableStorage, be.digestCache, request.InstanceName, scratchDir, outputDirectory)
+			if err != nil {
+				return err
+			}
+			result.OutputDirectories = append(result.OutputDirectories, directory)
+		}
+		return nil
+	})
+	if uploadErr != nil {
+		return phaseFailure(uploadPhaseCtx, uploadErr)
+	}
+	metadata.OutputUploadCompletedTimestamp = ptypes.TimestampNow()
+	metadata.WorkerCompletedTimestamp = metadata.OutputUploadCompletedTimestamp
+
 	return &remoteexecution.ExecuteResponse{
-		Result: &remoteexecution.ActionResult{
-			ExitCode:  123,
-			StderrRaw: []byte("Completed?\n"),
-		},
+		Result:       result,
+		CachedResult: false,
 	}, nil
 }
@@ -0,0 +1,191 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas/digest"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// putMessage marshals and stores a proto.Message, returning its
+// Digest so that it can be referenced by an ExecuteRequest.
+func putMessage(t *testing.T, ctx context.Context, blobAccess blobstore.BlobAccess, message proto.Message) *remoteexecution.Digest {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return putBlob(t, ctx, blobAccess, data)
+}
+
+// newTestExecutor wires up a localBuildExecutor against an in-memory
+// CAS, returning it alongside the CAS so that callers can stage
+// Action/Command protos and inspect uploaded outputs.
+func newTestExecutor(t *testing.T) (BuildExecutor, blobstore.BlobAccess) {
+	return newTestExecutorWithOptions(t, DefaultBuildExecutorOptions())
+}
+
+func newTestExecutorWithOptions(t *testing.T, options BuildExecutorOptions) (BuildExecutor, blobstore.BlobAccess) {
+	cas := blobstore.NewMemoryBlobAccess()
+	inputFileExposer := NewBlobAccessInputFileExposer(cas)
+	inputRootPopulator := NewBlobAccessInputRootPopulator(cas, inputFileExposer)
+	digestCache, err := digest.NewLRUDigestCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLocalBuildExecutor(cas, inputRootPopulator, digestCache, options), cas
+}
+
+// putAction stages a Command and an Action referencing it (with an
+// empty input root), returning an ExecuteRequest ready to pass to
+// Execute(). A zero timeout leaves the Action's Timeout field unset.
+func putAction(t *testing.T, ctx context.Context, cas blobstore.BlobAccess, command *remoteexecution.Command, timeout time.Duration) *remoteexecution.ExecuteRequest {
+	commandDigest := putMessage(t, ctx, cas, command)
+	inputRootDigest := putMessage(t, ctx, cas, &remoteexecution.Directory{})
+	action := &remoteexecution.Action{
+		CommandDigest:   commandDigest,
+		InputRootDigest: inputRootDigest,
+	}
+	if timeout != 0 {
+		action.Timeout = ptypes.DurationProto(timeout)
+	}
+	actionDigest := putMessage(t, ctx, cas, action)
+	return &remoteexecution.ExecuteRequest{ActionDigest: actionDigest}
+}
+
+func TestLocalBuildExecutorExecuteNonZeroExitCode(t *testing.T) {
+	executor, cas := newTestExecutor(t)
+	ctx := context.Background()
+
+	request := putAction(t, ctx, cas, &remoteexecution.Command{
+		Arguments: []string{"sh", "-c", "exit 3"},
+	}, 0)
+
+	response, err := executor.Execute(ctx, request)
+	if err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if response.Status != nil && response.Status.Code != 0 {
+		t.Fatalf("Execute() reported an infrastructure failure: %v", response.Status)
+	}
+	if response.Result.ExitCode != 3 {
+		t.Errorf("ExitCode = %d, want 3", response.Result.ExitCode)
+	}
+}
+
+func TestLocalBuildExecutorExecuteOutputFile(t *testing.T) {
+	executor, cas := newTestExecutor(t)
+	ctx := context.Background()
+
+	request := putAction(t, ctx, cas, &remoteexecution.Command{
+		Arguments:   []string{"sh", "-c", "echo -n hello > out.txt"},
+		OutputFiles: []string{"out.txt"},
+	}, 0)
+
+	response, err := executor.Execute(ctx, request)
+	if err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if response.Result.ExitCode != 0 {
+		t.Fatalf("ExitCode = %d, want 0", response.Result.ExitCode)
+	}
+	if len(response.Result.OutputFiles) != 1 {
+		t.Fatalf("OutputFiles = %v, want exactly one entry", response.Result.OutputFiles)
+	}
+	outputFile := response.Result.OutputFiles[0]
+	if outputFile.Path != "out.txt" {
+		t.Errorf("OutputFiles[0].Path = %q, want %q", outputFile.Path, "out.txt")
+	}
+	r := cas.Get(ctx, "", outputFile.Digest)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("uploaded out.txt = %q, want %q", data, "hello")
+	}
+}
+
+func TestLocalBuildExecutorExecuteOutputDirectory(t *testing.T) {
+	executor, cas := newTestExecutor(t)
+	ctx := context.Background()
+
+	request := putAction(t, ctx, cas, &remoteexecution.Command{
+		Arguments:         []string{"sh", "-c", "mkdir outdir && echo -n hello > outdir/a.txt"},
+		OutputDirectories: []string{"outdir"},
+	}, 0)
+
+	response, err := executor.Execute(ctx, request)
+	if err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if response.Result.ExitCode != 0 {
+		t.Fatalf("ExitCode = %d, want 0", response.Result.ExitCode)
+	}
+	if len(response.Result.OutputDirectories) != 1 {
+		t.Fatalf("OutputDirectories = %v, want exactly one entry", response.Result.OutputDirectories)
+	}
+	outputDirectory := response.Result.OutputDirectories[0]
+
+	r := cas.Get(ctx, "", outputDirectory.TreeDigest)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tree remoteexecution.Tree
+	if err := proto.Unmarshal(data, &tree); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.Root.Files) != 1 || tree.Root.Files[0].Name != "a.txt" {
+		t.Errorf("Tree.Root.Files = %v, want a single a.txt entry", tree.Root.Files)
+	}
+}
+
+func TestLocalBuildExecutorExecuteTimeoutExceeded(t *testing.T) {
+	executor, cas := newTestExecutor(t)
+	ctx := context.Background()
+
+	request := putAction(t, ctx, cas, &remoteexecution.Command{
+		Arguments: []string{"sh", "-c", "sleep 5"},
+	}, 200*time.Millisecond)
+
+	response, err := executor.Execute(ctx, request)
+	if err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if response.Status == nil || response.Status.Code != 4 {
+		t.Fatalf("Status = %v, want code 4 (DEADLINE_EXCEEDED)", response.Status)
+	}
+}
+
+func TestLocalBuildExecutorExecuteRejectsUnsatisfiedPlatform(t *testing.T) {
+	options := DefaultBuildExecutorOptions()
+	options.Platform = map[string]string{"OSFamily": "Linux"}
+	executor, cas := newTestExecutorWithOptions(t, options)
+	ctx := context.Background()
+
+	request := putAction(t, ctx, cas, &remoteexecution.Command{
+		Arguments: []string{"sh", "-c", "exit 0"},
+		Platform: &remoteexecution.Platform{
+			Properties: []*remoteexecution.Platform_Property{
+				{Name: "OSFamily", Value: "Windows"},
+			},
+		},
+	}, 0)
+
+	response, err := executor.Execute(ctx, request)
+	if err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if response.Status == nil || response.Status.Code != 9 {
+		t.Fatalf("Status = %v, want code 9 (FAILED_PRECONDITION)", response.Status)
+	}
+}
@@ -0,0 +1,62 @@
+package builder
+
+import "time"
+
+// BuildExecutorOptions configures how a localBuildExecutor divides an
+// Action's overall timeout across the phases of Execute(). Fractions
+// should sum to 1.0; a phase given a fraction of zero (or, except for
+// the Inventory phase, an action with no Action.timeout at all) runs
+// without a deadline of its own. The Inventory phase is budgeted
+// against defaultInventoryTotalTimeout instead; see inventoryBudget().
+type BuildExecutorOptions struct {
+	InventoryFraction    float64
+	InputTreeFraction    float64
+	SetupFraction        float64
+	ExecFraction         float64
+	OutputUploadFraction float64
+
+	// Platform holds the properties this worker satisfies (e.g.
+	// "OSFamily": "Linux"). An action whose Platform requires a
+	// property this worker doesn't provide, or provides with a
+	// different value, is rejected rather than run anyway. A nil
+	// map (the zero value) disables the check entirely, accepting
+	// any action's platform requirements unconditionally.
+	Platform map[string]string
+}
+
+// defaultInventoryTotalTimeout stands in for an Action's overall
+// timeout while budgeting the Inventory phase, since that phase is
+// what fetches the Action in the first place: its own Timeout field
+// isn't known yet. It's a generous ceiling on how long fetching an
+// Action and Command proto from the CAS should ever take.
+const defaultInventoryTotalTimeout = 5 * time.Minute
+
+// DefaultBuildExecutorOptions returns the fractions used by
+// NewLocalBuildExecutor when the caller has no reason to deviate from
+// them.
+func DefaultBuildExecutorOptions() BuildExecutorOptions {
+	return BuildExecutorOptions{
+		InventoryFraction:    0.05,
+		InputTreeFraction:    0.25,
+		SetupFraction:        0.05,
+		ExecFraction:         0.55,
+		OutputUploadFraction: 0.10,
+	}
+}
+
+// budget returns the slice of total allotted to a phase given its
+// fraction, or zero (no deadline) if total itself is zero.
+func (o BuildExecutorOptions) budget(fraction float64, total time.Duration) time.Duration {
+	if total == 0 {
+		return 0
+	}
+	return time.Duration(float64(total) * fraction)
+}
+
+// inventoryBudget returns the deadline for the Inventory phase. It is
+// budgeted against defaultInventoryTotalTimeout rather than the
+// Action's own timeout, because the Action (and its Timeout field)
+// isn't available until the Inventory phase has fetched it.
+func (o BuildExecutorOptions) inventoryBudget() time.Duration {
+	return o.budget(o.InventoryFraction, defaultInventoryTotalTimeout)
+}
@@ -0,0 +1,151 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/EdSchouten/bazel-buildbarn/pkg/blobstore"
+	"github.com/EdSchouten/bazel-buildbarn/pkg/cas/digest"
+	"github.com/golang/protobuf/proto"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// digestAndUploadBlob computes the Digest of an in-memory blob (e.g.
+// a serialized Directory or Tree proto, or captured stdout/stderr)
+// and stores it in the CAS, returning the Digest so that it can be
+// referenced from an ActionResult.
+func digestAndUploadBlob(ctx context.Context, blobAccess blobstore.BlobAccess, instance string, data []byte) (*remoteexecution.Digest, error) {
+	d, err := digest.Hash(digest.NewBytesSource(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := blobAccess.Put(ctx, instance, d, d.SizeBytes, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// uploadOutputFile reads a single regular file produced by an action
+// and stores it in the CAS. Digests are obtained through
+// digestCache, keyed by the file's full path, so a cached digest is
+// only reused for the same path with an unchanged mtime and size.
+// The file is hashed once and then read again for the upload.
+func uploadOutputFile(ctx context.Context, blobAccess blobstore.BlobAccess, digestCache digest.DigestCache, instance, root, relPath string) (*remoteexecution.OutputFile, error) {
+	fullPath := filepath.Join(root, relPath)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	source := digest.NewFileSource(fullPath)
+	d, err := digestCache.Get(ctx, fullPath, source)
+	if err != nil {
+		return nil, err
+	}
+	r, err := source.NewReader()
+	if err != nil {
+		return nil, err
+	}
+	if d.SizeBytes > blobstore.DefaultChunkSizeBytes {
+		// Stream large outputs (e.g. linked binaries) in bounded
+		// chunks instead of relying on the backend to buffer them.
+		err = blobAccess.PutStream(ctx, instance, d, d.SizeBytes, blobstore.DefaultChunkSizeBytes, r)
+	} else {
+		err = blobAccess.Put(ctx, instance, d, d.SizeBytes, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &remoteexecution.OutputFile{
+		Path:         relPath,
+		Digest:       d,
+		IsExecutable: info.Mode()&0111 != 0,
+	}, nil
+}
+
+// buildDirectoryProto recursively walks a directory on disk,
+// uploading every file it contains, and returns the resulting
+// Directory proto along with the Directory protos of all of its
+// descendants (needed to populate a Tree's Children field).
+func buildDirectoryProto(ctx context.Context, blobAccess blobstore.BlobAccess, digestCache digest.DigestCache, instance, root, relPath string) (*remoteexecution.Directory, []*remoteexecution.Directory, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(root, relPath))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	directory := &remoteexecution.Directory{}
+	var descendants []*remoteexecution.Directory
+	for _, entry := range entries {
+		entryRelPath := filepath.Join(relPath, entry.Name())
+		switch {
+		case entry.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filepath.Join(root, entryRelPath))
+			if err != nil {
+				return nil, nil, err
+			}
+			directory.Symlinks = append(directory.Symlinks, &remoteexecution.SymlinkNode{
+				Name:   entry.Name(),
+				Target: target,
+			})
+		case entry.IsDir():
+			childDirectory, childDescendants, err := buildDirectoryProto(ctx, blobAccess, digestCache, instance, root, entryRelPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			data, err := proto.Marshal(childDirectory)
+			if err != nil {
+				return nil, nil, err
+			}
+			childDigest, err := digestAndUploadBlob(ctx, blobAccess, instance, data)
+			if err != nil {
+				return nil, nil, err
+			}
+			directory.Directories = append(directory.Directories, &remoteexecution.DirectoryNode{
+				Name:   entry.Name(),
+				Digest: childDigest,
+			})
+			descendants = append(descendants, childDirectory)
+			descendants = append(descendants, childDescendants...)
+		default:
+			outputFile, err := uploadOutputFile(ctx, blobAccess, digestCache, instance, root, entryRelPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			directory.Files = append(directory.Files, &remoteexecution.FileNode{
+				Name:         entry.Name(),
+				Digest:       outputFile.Digest,
+				IsExecutable: outputFile.IsExecutable,
+			})
+		}
+	}
+	return directory, descendants, nil
+}
+
+// uploadOutputDirectory uploads every file underneath a directory
+// produced by an action, serializes the resulting tree as a Tree
+// proto, and stores that in the CAS.
+func uploadOutputDirectory(ctx context.Context, blobAccess blobstore.BlobAccess, digestCache digest.DigestCache, instance, root, relPath string) (*remoteexecution.OutputDirectory, error) {
+	rootDirectory, children, err := buildDirectoryProto(ctx, blobAccess, digestCache, instance, root, relPath)
+	if err != nil {
+		return nil, err
+	}
+	tree := &remoteexecution.Tree{
+		Root:     rootDirectory,
+		Children: children,
+	}
+	data, err := proto.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	treeDigest, err := digestAndUploadBlob(ctx, blobAccess, instance, data)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteexecution.OutputDirectory{
+		Path:       relPath,
+		TreeDigest: treeDigest,
+	}, nil
+}
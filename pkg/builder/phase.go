@@ -0,0 +1,60 @@
+package builder
+
+import (
+	"context"
+	"time"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// Named phases of action execution. Each gets its own span and its
+// own slice of the Action's overall timeout budget, modeled after the
+// SpanTimeout pattern used by goma's remoteexec adapter.
+const (
+	PhaseInventory    = "Inventory"
+	PhaseInputTree    = "InputTree"
+	PhaseSetup        = "Setup"
+	PhaseExec         = "Exec"
+	PhaseOutputUpload = "OutputUpload"
+)
+
+var (
+	phaseTagKey = tag.MustNewKey("phase")
+
+	// PhaseDuration measures how long Execute() spends in each
+	// named phase, tagged by phase name.
+	PhaseDuration = stats.Float64("buildbarn.io/builder/phase_duration_seconds", "Time spent in each phase of action execution", stats.UnitSeconds)
+)
+
+// runPhase wraps f in an OpenCensus span labelled after phase,
+// applies budget as a deadline on the context passed to f (unless
+// budget is zero), and records how long f took to run. It returns
+// the (possibly deadline-bound) context so that callers can inspect
+// its error after f returns, e.g. to detect that the budget for this
+// phase was exceeded.
+func runPhase(ctx context.Context, phase string, budget time.Duration, instance string, digest *remoteexecution.Digest, f func(context.Context) error) (context.Context, error) {
+	phaseCtx, span := trace.StartSpan(ctx, "builder.Execute/"+phase)
+	defer span.End()
+	span.AddAttributes(
+		trace.StringAttribute("instance", instance),
+		trace.StringAttribute("action_digest", digest.GetHash()),
+		trace.Int64Attribute("action_size_bytes", digest.GetSizeBytes()),
+	)
+
+	if budget > 0 {
+		var cancel context.CancelFunc
+		phaseCtx, cancel = context.WithTimeout(phaseCtx, budget)
+		defer cancel()
+	}
+
+	start := time.Now()
+	err := f(phaseCtx)
+
+	if tagCtx, tagErr := tag.New(ctx, tag.Upsert(phaseTagKey, phase)); tagErr == nil {
+		stats.Record(tagCtx, PhaseDuration.M(time.Since(start).Seconds()))
+	}
+	return phaseCtx, err
+}
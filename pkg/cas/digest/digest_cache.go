@@ -0,0 +1,63 @@
+package digest
+
+import (
+	"context"
+	"os"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// DigestCache computes the Digest of a Source, keyed by a caller
+// supplied key (typically a file path). Results are cached against
+// the key's on-disk mtime and size, so that repeated hashes of the
+// same unchanged file across builds are served without rereading it.
+// This mirrors goma's DigestCache.
+type DigestCache interface {
+	Get(ctx context.Context, key string, source Source) (*remoteexecution.Digest, error)
+}
+
+type digestCacheEntry struct {
+	modTime   int64
+	sizeBytes int64
+	digest    *remoteexecution.Digest
+}
+
+type lruDigestCache struct {
+	cache *lru.Cache
+}
+
+// NewLRUDigestCache creates a DigestCache backed by an in-memory LRU
+// holding up to size entries.
+func NewLRUDigestCache(size int) (DigestCache, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &lruDigestCache{cache: cache}, nil
+}
+
+func (dc *lruDigestCache) Get(ctx context.Context, key string, source Source) (*remoteexecution.Digest, error) {
+	info, statErr := os.Stat(key)
+	if statErr == nil {
+		if v, ok := dc.cache.Get(key); ok {
+			entry := v.(digestCacheEntry)
+			if entry.modTime == info.ModTime().UnixNano() && entry.sizeBytes == info.Size() {
+				return entry.digest, nil
+			}
+		}
+	}
+
+	digest, err := Hash(source)
+	if err != nil {
+		return nil, err
+	}
+	if statErr == nil {
+		dc.cache.Add(key, digestCacheEntry{
+			modTime:   info.ModTime().UnixNano(),
+			sizeBytes: info.Size(),
+			digest:    digest,
+		})
+	}
+	return digest, nil
+}
@@ -0,0 +1,62 @@
+package digest
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLRUDigestCacheGet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "digest-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "f")
+	if err := ioutil.WriteFile(path, []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewLRUDigestCache(16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	d1, err := cache.Get(ctx, path, NewFileSource(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Hash(NewBytesSource([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d1.Hash != want.Hash {
+		t.Errorf("Get() = %q, want %q", d1.Hash, want.Hash)
+	}
+
+	// A second Get() against the same unchanged file must return a
+	// cache hit without rehashing it: replace the file's contents
+	// without touching its mtime/size, so a rehash would be
+	// detected by returning a different digest.
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("HELLO"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	d2, err := cache.Get(ctx, path, NewFileSource(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.Hash != d1.Hash {
+		t.Errorf("cached Get() = %q, want cache hit %q", d2.Hash, d1.Hash)
+	}
+}
@@ -0,0 +1,29 @@
+package digest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	remoteexecution "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+)
+
+// Hash reads all of a Source's contents in fixed-size chunks,
+// computing its SHA-256 digest.
+func Hash(source Source) (*remoteexecution.Digest, error) {
+	r, err := source.NewReader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	sizeBytes, err := io.CopyBuffer(hasher, r, make([]byte, sourceChunkSize))
+	if err != nil {
+		return nil, err
+	}
+	return &remoteexecution.Digest{
+		Hash:      hex.EncodeToString(hasher.Sum(nil)),
+		SizeBytes: sizeBytes,
+	}, nil
+}
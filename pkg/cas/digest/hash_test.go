@@ -0,0 +1,32 @@
+package digest
+
+import "testing"
+
+func TestHashBytesSource(t *testing.T) {
+	d, err := Hash(NewBytesSource([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256("hello")
+	const want = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if d.Hash != want {
+		t.Errorf("Hash = %q, want %q", d.Hash, want)
+	}
+	if d.SizeBytes != 5 {
+		t.Errorf("SizeBytes = %d, want 5", d.SizeBytes)
+	}
+}
+
+func TestHashEmptySource(t *testing.T) {
+	d, err := Hash(NewBytesSource(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if d.Hash != want {
+		t.Errorf("Hash = %q, want %q", d.Hash, want)
+	}
+	if d.SizeBytes != 0 {
+		t.Errorf("SizeBytes = %d, want 0", d.SizeBytes)
+	}
+}
@@ -0,0 +1,62 @@
+package digest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// sourceChunkSize is the chunk size used while hashing a Source.
+const sourceChunkSize = 1 << 20 // 1 MiB
+
+// Source is something that can be hashed to produce a Digest, and
+// read back again afterwards (e.g. for uploading to CAS) without
+// needing to be hashed a second time.
+type Source interface {
+	// NewReader returns a fresh reader over the object's contents.
+	NewReader() (io.ReadCloser, error)
+}
+
+type fileSource struct {
+	path string
+}
+
+// NewFileSource creates a Source that reads its contents from a file
+// on local disk.
+func NewFileSource(path string) Source {
+	return &fileSource{path: path}
+}
+
+func (s *fileSource) NewReader() (io.ReadCloser, error) {
+	return os.Open(s.path)
+}
+
+type readerAtSource struct {
+	r         io.ReaderAt
+	sizeBytes int64
+}
+
+// NewReaderAtSource creates a Source that reads its contents from an
+// io.ReaderAt of known size, such as an *os.File opened elsewhere or
+// a memory-mapped region.
+func NewReaderAtSource(r io.ReaderAt, sizeBytes int64) Source {
+	return &readerAtSource{r: r, sizeBytes: sizeBytes}
+}
+
+func (s *readerAtSource) NewReader() (io.ReadCloser, error) {
+	return ioutil.NopCloser(io.NewSectionReader(s.r, 0, s.sizeBytes)), nil
+}
+
+type bytesSource struct {
+	data []byte
+}
+
+// NewBytesSource creates a Source backed by an in-memory byte slice.
+func NewBytesSource(data []byte) Source {
+	return &bytesSource{data: data}
+}
+
+func (s *bytesSource) NewReader() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(s.data)), nil
+}